@@ -0,0 +1,99 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package config holds the identity configuration produced by enrollment and the claims carried by
+// an enrollment JWT.
+package config
+
+import (
+	"crypto/x509"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/openziti/foundation/identity/identity"
+)
+
+// Config is the result of a successful enrollment: an identity.Config (the key/cert/ca material,
+// addressed by whatever URI scheme produced or loaded them) plus the controller API this identity
+// enrolled against.
+type Config struct {
+	ZtAPI string
+	ID    identity.Config
+
+	// ACMEAccountURL and ACMEAccountKey persist the ACME account this identity registered (or
+	// reused) during "acme" enrollment, so a later renewal reuses the same account instead of
+	// registering a new one. They live here, not on ID, because identity.Config is defined in
+	// github.com/openziti/foundation and can't grow ACME-specific fields.
+	ACMEAccountURL string
+	ACMEAccountKey string
+}
+
+// EnrollmentClaims are the claims carried by an enrollment JWT, parsed by ParseToken and validated
+// by ValidateToken. Which of the method-specific fields are populated depends on EnrollmentMethod.
+type EnrollmentClaims struct {
+	jwt.StandardClaims
+
+	EnrollmentMethod string `json:"em"`
+
+	// SignatureCert is the certificate ValidateToken fetched from Issuer to verify this token's
+	// signature. It is not part of the wire JWT.
+	SignatureCert *x509.Certificate `json:"-"`
+
+	// ACMEDirectoryURL is the ACME server's directory endpoint for "acme" enrollment.
+	ACMEDirectoryURL string `json:"acmeDirectoryUrl,omitempty"`
+
+	// ACMEIdentifiers are the dns identifiers to request a certificate for during "acme"
+	// enrollment. The first entry is used as the certificate's CN.
+	ACMEIdentifiers []string `json:"acmeIdentifiers,omitempty"`
+
+	// ACMEAccountEmail is the contact email registered with the ACME account.
+	ACMEAccountEmail string `json:"acmeAccountEmail,omitempty"`
+
+	// ACMEChallengeType selects which offered challenge (e.g. "http-01", "dns-01", "tls-alpn-01")
+	// acmeSolveAuthorization answers.
+	ACMEChallengeType string `json:"acmeChallengeType,omitempty"`
+
+	// ACMEExternalAccountBindingKID and ACMEExternalAccountBindingHMAC carry the RFC 8555
+	// section 7.3.4 external account binding credentials issued out-of-band by the CA. Both must
+	// be set to register via EAB; an empty ACMEExternalAccountBindingKID means EAB is not used.
+	ACMEExternalAccountBindingKID  string `json:"acmeEabKid,omitempty"`
+	ACMEExternalAccountBindingHMAC string `json:"acmeEabHmac,omitempty"`
+
+	// ACMEHTTPSolver, ACMEDNSSolver and ACMETLSALPNSolver are caller-provided challenge solvers,
+	// not part of the wire JWT. Exactly one needs to be set, matching ACMEChallengeType; each is
+	// type-asserted against the corresponding Solver interface (HTTPSolver, DNSSolver,
+	// TLSALPNSolver) when its challenge type is solved.
+	ACMEHTTPSolver    interface{} `json:"-"`
+	ACMEDNSSolver     interface{} `json:"-"`
+	ACMETLSALPNSolver interface{} `json:"-"`
+
+	// CloudAudience is the expected audience/resource bound into the cloud provider's attestation
+	// token during "aws", "azure" or "gcp" enrollment (e.g. the GCP identity token's "audience"
+	// query parameter, or the Azure MSI token's "resource").
+	CloudAudience string `json:"cloudAudience,omitempty"`
+
+	// ESTUsername, ESTPassword and ESTBase64Encode configure the est.Client used for "est"
+	// enrollment.
+	ESTUsername     string `json:"estUsername,omitempty"`
+	ESTPassword     string `json:"estPassword,omitempty"`
+	ESTBase64Encode bool   `json:"estBase64Encode,omitempty"`
+}
+
+// EnrolmentUrl is the endpoint an enrollment method POSTs its CSR (or equivalent) to. The
+// controller issues the enrollment JWT with Issuer already set to this concrete, single-use
+// endpoint.
+func (c *EnrollmentClaims) EnrolmentUrl() string {
+	return c.Issuer
+}
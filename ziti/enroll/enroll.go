@@ -18,24 +18,25 @@ package enroll
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
 	"github.com/Jeffail/gabs"
 	"github.com/dgrijalva/jwt-go"
-	"github.com/fullsailor/pkcs7"
 	"github.com/michaelquigley/pfxlog"
+	"github.com/netfoundry/ziti-sdk-golang/ziti/config"
+	"github.com/netfoundry/ziti-sdk-golang/ziti/enroll/est"
+	"github.com/netfoundry/ziti-sdk-golang/ziti/enroll/kms"
 	"github.com/openziti/foundation/identity/certtools"
 	"github.com/openziti/foundation/identity/identity"
 	nfpem "github.com/openziti/foundation/util/pem"
 	"github.com/openziti/foundation/util/x509"
-	"github.com/openziti/sdk-golang/ziti/config"
 	"github.com/pkg/errors"
 	"io/ioutil"
 	"net/http"
@@ -54,6 +55,12 @@ type EnrollmentFlags struct {
 	KeyFile       string
 	IDName        string
 	AdditionalCAs string
+
+	// KeyManager, when set, is used in place of an in-process generated key for every enrollment
+	// method that needs to mint a CSR. cfg.ID.Key ends up holding whatever opaque KeyURI the
+	// manager returns (a "pem:" literal for the software default, or an HSM/KMS URI otherwise)
+	// instead of raw key material.
+	KeyManager kms.KeyManager
 }
 
 func ParseToken(tokenStr string) (*config.EnrollmentClaims, *jwt.Token, error) {
@@ -86,6 +93,18 @@ func ValidateToken(token *jwt.Token) (interface{}, error) {
 		return nil, errors.New("could not validate token, EnrollmentClaims are nil")
 	}
 
+	switch claims.EnrollmentMethod {
+	case "aws", "azure", "gcp":
+		// Cloud-identity enrollment is authenticated by the cloud provider's own attestation (the
+		// instance identity document/signature or MSI/service-account token), which the controller
+		// checks server-side against the submitted CSR - there is no traditional controller-signed
+		// JWT to verify an issuer certificate against, so these tokens are accepted unsigned.
+		if token.Method != jwt.SigningMethodNone {
+			return nil, errors.Errorf("cloud enrollment method '%s' requires an unsigned token", claims.EnrollmentMethod)
+		}
+		return jwt.UnsafeAllowNoneSignatureType, nil
+	}
+
 	if claims.Issuer == "" {
 		return nil, errors.New("could not validate token, issues is empty")
 	}
@@ -96,7 +115,7 @@ func ValidateToken(token *jwt.Token) (interface{}, error) {
 		return nil, errors.Errorf("could not validate token, issuer [%s] is not a valid url ", claims.Issuer)
 	}
 
-	cert, err := FetchServerCert(claims.Issuer)
+	cert, err := FetchServerCert(context.Background(), claims.Issuer)
 
 	claims.SignatureCert = cert
 
@@ -107,22 +126,25 @@ func ValidateToken(token *jwt.Token) (interface{}, error) {
 	return cert.PublicKey, nil
 }
 
+// Enroll runs enFlags through to completion using the default, non-cancellable, two-pass retry
+// behavior. It is kept for backwards compatibility; new callers that want cancellation, progress
+// events, or a configurable retry policy should use NewEnroller instead.
 func Enroll(enFlags EnrollmentFlags) (*config.Config, error) {
-	var key crypto.PrivateKey
-	var err error
-	cfg := &config.Config{
-		ZtAPI: enFlags.Token.Issuer,
-	}
+	return NewEnroller(WithFlags(enFlags)).Enroll(context.Background())
+}
+
+func stageKey(ctx context.Context, e *Enroller, cfg *config.Config) error {
+	enFlags := e.flags
 
 	if strings.TrimSpace(enFlags.KeyFile) != "" {
 		stat, err := os.Stat(enFlags.KeyFile)
 
 		if stat != nil && !os.IsNotExist(err) {
 			if stat.IsDir() {
-				return nil, errors.Errorf("specified key is a directory (%s)", enFlags.KeyFile)
+				return errors.Errorf("specified key is a directory (%s)", enFlags.KeyFile)
 			}
 			if absPath, fileErr := filepath.Abs(enFlags.KeyFile); fileErr != nil {
-				return nil, fileErr
+				return fileErr
 			} else {
 				cfg.ID.Key = "file://" + absPath
 			}
@@ -130,14 +152,49 @@ func Enroll(enFlags EnrollmentFlags) (*config.Config, error) {
 			cfg.ID.Key = enFlags.KeyFile
 			pfxlog.Logger().Infof("using engine : %s\n", strings.Split(enFlags.KeyFile, ":")[0])
 		}
-	} else {
-		key, err = generateKey()
-		asnBytes, _ := x509.MarshalECPrivateKey(key.(*ecdsa.PrivateKey))
-		keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: asnBytes})
-		cfg.ID.Key = "pem:" + string(keyPem)
-		if err != nil {
-			return nil, err
-		}
+		return nil
+	}
+
+	if resumed, err := e.resumeKey(cfg); err != nil {
+		return err
+	} else if resumed {
+		return nil
+	}
+
+	keyManager := enFlags.KeyManager
+	if keyManager == nil {
+		keyManager = kms.NewSoftware()
+	}
+
+	_, keyURI, err := keyManager.CreateKey(kms.KeySpec{})
+	if err != nil {
+		return err
+	}
+	cfg.ID.Key = string(keyURI)
+
+	// Persist the key before any network call is made: if the process crashes mid-enrollment the
+	// same key material is reused on the next attempt instead of silently generating (and
+	// orphaning, server-side) a new one.
+	if err := e.persistKey(cfg.ID.Key); err != nil {
+		return errors.Errorf("failed to persist generated key: %s", err.Error())
+	}
+
+	e.emit(KeyGenerated{KeyURI: cfg.ID.Key})
+	return nil
+}
+
+// enroll runs enFlags through to completion, retrying up to e.maxAttempts times on an
+// UnknownAuthority TLS error (on the first retry the CAs fetched from the server, trusted via the
+// token's signature cert, are added to the pool) and otherwise returning the first error
+// encountered. ctx is threaded through every outbound HTTP call.
+func (e *Enroller) enroll(ctx context.Context) (*config.Config, error) {
+	enFlags := e.flags
+	cfg := &config.Config{
+		ZtAPI: enFlags.Token.Issuer,
+	}
+
+	if err := stageKey(ctx, e, cfg); err != nil {
+		return nil, err
 	}
 
 	caPool := x509.NewCertPool()
@@ -160,19 +217,32 @@ func Enroll(enFlags EnrollmentFlags) (*config.Config, error) {
 
 	enrollmentComplete := false
 	shouldFetchCerts := true
+	attempt := 0
 
 	var enrollErr error
 
-	//loop two times at most. if the correct certs are in the jwt or the overridden ca file then the enrollment will function properly
-	//if not - fetch the certificates from the server - add them to the caPool and try again a second time
 	for !enrollmentComplete {
+		if err := ctx.Err(); err != nil {
+			return cfg, err
+		}
+
 		switch enFlags.Token.EnrollmentMethod {
 		case "ott":
-			enrollErr = enrollOTT(enFlags.Token, cfg, caPool)
+			enrollErr = enrollOTT(ctx, enFlags, cfg, caPool)
 		case "ottca":
-			enrollErr = enrollCA(enFlags.Token, cfg, caPool)
+			enrollErr = enrollCA(ctx, enFlags.Token, cfg, caPool)
 		case "ca":
-			enrollErr = enrollCAAuto(enFlags, cfg, caPool)
+			enrollErr = enrollCAAuto(ctx, enFlags, cfg, caPool)
+		case "acme":
+			enrollErr = enrollACME(ctx, enFlags, cfg, caPool)
+		case "est":
+			enrollErr = enrollEST(ctx, enFlags, cfg, caPool)
+		case "aws":
+			enrollErr = enrollAWS(ctx, enFlags, cfg, caPool)
+		case "azure":
+			enrollErr = enrollAzure(ctx, enFlags, cfg, caPool)
+		case "gcp":
+			enrollErr = enrollGCP(ctx, enFlags, cfg, caPool)
 		default:
 			enrollErr = errors.Errorf("enrollment method '%s' is not supported", enFlags.Token.EnrollmentMethod)
 			enrollmentComplete = true //no need to try again
@@ -180,30 +250,47 @@ func Enroll(enFlags EnrollmentFlags) (*config.Config, error) {
 
 		if enrollErr == nil {
 			enrollmentComplete = true //enrollment was successful
+			e.emit(CSRSubmitted{Method: enFlags.Token.EnrollmentMethod})
 		} else {
 			//determine if the failure is expected or due to tls. if tls related - retry. if not - just carry on without retrying
 			urlErr, ok := enrollErr.(*url.Error)
+			retryable := false
 			if ok {
-				_, okx509 := urlErr.Err.(x509.UnknownAuthorityError)
-				if okx509 && shouldFetchCerts {
-					// don't try to fetch certs again
+				if _, okx509 := urlErr.Err.(x509.UnknownAuthorityError); okx509 {
+					retryable = true
+				}
+			}
+
+			if retryable && attempt < e.maxAttempts {
+				attempt++
+				e.emit(Retry{Err: enrollErr, Attempt: attempt})
+
+				if shouldFetchCerts {
+					// only fetch certs once: if the first fetch didn't produce a trusted CA, the
+					// server isn't going to hand us a different answer on the next attempt.
 					shouldFetchCerts = false
 
 					pfxlog.Logger().Debug("fetching certificates from server")
 					rootCaPool := x509.NewCertPool()
 					rootCaPool.AddCert(enFlags.Token.SignatureCert)
 
-					for _, xcert := range FetchCertificates(cfg.ZtAPI, rootCaPool) {
+					fetched := FetchCertificates(ctx, cfg.ZtAPI, rootCaPool)
+					for _, xcert := range fetched {
 						allowedCerts = append(allowedCerts, xcert)
 						caPool.AddCert(xcert)
 					}
+					e.emit(CAsFetched{Count: len(fetched)})
+				}
 
-					//certs fetched - try again
-					continue
+				if backoffErr := e.wait(ctx); backoffErr != nil {
+					return cfg, backoffErr
 				}
+
+				//try again
+				continue
 			}
 
-			// if any error other than a tls-related error occurs just return it - don't try again
+			// if any error other than a tls-related error occurs, or retries are exhausted, give up
 			return cfg, enrollErr
 		}
 	}
@@ -217,6 +304,8 @@ func Enroll(enFlags EnrollmentFlags) (*config.Config, error) {
 		cfg.ID.CA = "pem:" + buf.String()
 	}
 
+	e.emit(CertificateIssued{Cert: cfg.ID.Cert})
+
 	return cfg, nil // success
 }
 
@@ -226,6 +315,12 @@ func generateKey() (crypto.PrivateKey, error) {
 	return ecdsa.GenerateKey(p384, rand.Reader)
 }
 
+// GenerateKey is the exported form of generateKey, usable by other packages in this module (such as
+// ziti/enroll/renew) that need to mint a fresh identity key outside of the Enroll flow.
+func GenerateKey() (crypto.PrivateKey, error) {
+	return generateKey()
+}
+
 func useSystemCasIfEmpty(caPool *x509.CertPool) *x509.CertPool {
 	if len(caPool.Subjects()) < 1 {
 		pfxlog.Logger().Debugf("no cas provided in caPool. using system provided cas")
@@ -237,11 +332,34 @@ func useSystemCasIfEmpty(caPool *x509.CertPool) *x509.CertPool {
 	}
 }
 
-func enrollOTT(token *config.EnrollmentClaims, cfg *config.Config, caPool *x509.CertPool) error {
+// resolveSigner returns the crypto.Signer for cfg.ID.Key, going through enFlags.KeyManager when one
+// is configured (required for HSM/KMS-backed keys) and falling back to identity.LoadKey otherwise.
+func resolveSigner(enFlags EnrollmentFlags, cfg *config.Config) (crypto.Signer, error) {
+	if enFlags.KeyManager != nil {
+		signer, err := enFlags.KeyManager.GetSigner(kms.KeyURI(cfg.ID.Key))
+		if err != nil {
+			return nil, errors.Errorf("failed to resolve private key '%s': %s", cfg.ID.Key, err.Error())
+		}
+		return signer, nil
+	}
 
-	pk, err := identity.LoadKey(cfg.ID.Key)
+	key, err := identity.LoadKey(cfg.ID.Key)
 	if err != nil {
-		return errors.Errorf("failed to load private key '%s': %s", cfg.ID.Key, err.Error())
+		return nil, errors.Errorf("failed to load private key '%s': %s", cfg.ID.Key, err.Error())
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("configured key does not support signing")
+	}
+	return signer, nil
+}
+
+func enrollOTT(ctx context.Context, enFlags EnrollmentFlags, cfg *config.Config, caPool *x509.CertPool) error {
+	token := enFlags.Token
+
+	pk, err := resolveSigner(enFlags, cfg)
+	if err != nil {
+		return err
 	}
 
 	hostname, err := os.Hostname()
@@ -265,7 +383,13 @@ func enrollOTT(token *config.EnrollmentClaims, cfg *config.Config, caPool *x509.
 			},
 		},
 	}
-	resp, err := client.Post(token.EnrolmentUrl(), "text/plain", bytes.NewReader(csrPem))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, token.EnrolmentUrl(), bytes.NewReader(csrPem))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+
+	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
@@ -307,7 +431,7 @@ func enrollOTT(token *config.EnrollmentClaims, cfg *config.Config, caPool *x509.
 	return errors.Errorf("enroll error: %s: unrecognized response: %s", resp.Status, body)
 }
 
-func enrollCA(token *config.EnrollmentClaims, cfg *config.Config, caPool *x509.CertPool) error {
+func enrollCA(ctx context.Context, token *config.EnrollmentClaims, cfg *config.Config, caPool *x509.CertPool) error {
 
 	if id, err := identity.LoadIdentity(cfg.ID); err != nil {
 		return err
@@ -323,7 +447,13 @@ func enrollCA(token *config.EnrollmentClaims, cfg *config.Config, caPool *x509.C
 				},
 			},
 		}
-		resp, err := client.Post(token.EnrolmentUrl(), "text/plain", bytes.NewReader([]byte{}))
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, token.EnrolmentUrl(), bytes.NewReader([]byte{}))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "text/plain")
+
+		resp, err := client.Do(req)
 		if err != nil {
 			return err
 		}
@@ -343,7 +473,7 @@ type autoEnrollInput struct {
 	Name string `json:"name"`
 }
 
-func enrollCAAuto(enFlags EnrollmentFlags, cfg *config.Config, caPool *x509.CertPool) error {
+func enrollCAAuto(ctx context.Context, enFlags EnrollmentFlags, cfg *config.Config, caPool *x509.CertPool) error {
 	if id, err := identity.LoadIdentity(cfg.ID); err != nil {
 		return err
 	} else {
@@ -372,7 +502,13 @@ func enrollCAAuto(enFlags EnrollmentFlags, cfg *config.Config, caPool *x509.Cert
 			postBody = pb
 		}
 
-		resp, postErr := client.Post(enFlags.Token.EnrolmentUrl(), "application/json", bytes.NewReader(postBody))
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, enFlags.Token.EnrolmentUrl(), bytes.NewReader(postBody))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, postErr := client.Do(req)
 		if postErr != nil {
 			return postErr
 		}
@@ -399,13 +535,18 @@ func enrollCAAuto(enFlags EnrollmentFlags, cfg *config.Config, caPool *x509.Cert
 	}
 }
 
-func FetchServerCert(urlRoot string) (*x509.Certificate, error) {
+func FetchServerCert(ctx context.Context, urlRoot string) (*x509.Certificate, error) {
 	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 	}
 	client := &http.Client{Transport: tr}
 
-	resp, err := client.Get(urlRoot)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlRoot, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
 
 	if err != nil {
 		return nil, errors.Errorf("could not contact remote server [%s]: %s", urlRoot, err)
@@ -420,7 +561,7 @@ func FetchServerCert(urlRoot string) (*x509.Certificate, error) {
 
 // FetchCertificates will accecss the server insecurely to pull down the latest CA to be used to communicate with the
 // server adding certificates to the provided pool
-func FetchCertificates(urlRoot string, rootCaPool *x509.CertPool) []*x509.Certificate {
+func FetchCertificates(ctx context.Context, urlRoot string, rootCaPool *x509.CertPool) []*x509.Certificate {
 	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{RootCAs: rootCaPool},
 	}
@@ -433,7 +574,13 @@ func FetchCertificates(urlRoot string, rootCaPool *x509.CertPool) []*x509.Certif
 
 	certStoreUrl.Path = path.Join(certStoreUrl.Path, ".well-known/est/cacerts") //specified by rfc7030
 
-	resp, respErr := client.Get(certStoreUrl.String())
+	req, reqErr := http.NewRequestWithContext(ctx, http.MethodGet, certStoreUrl.String(), nil)
+	if reqErr != nil {
+		pfxlog.Logger().WithError(reqErr).WithField("url", urlRoot).Error("could not build CA store request")
+		return nil
+	}
+
+	resp, respErr := client.Do(req)
 
 	if respErr != nil {
 		//if an error occurs, log the issue and just return a nil slice of certs
@@ -454,15 +601,12 @@ func FetchCertificates(urlRoot string, rootCaPool *x509.CertPool) []*x509.Certif
 
 	if resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusMultipleChoices {
 
-		pkcs7Certs, _ := base64.StdEncoding.DecodeString(string(pkcs7b64))
-		if pkcs7Certs != nil {
-			certs, parseErr := pkcs7.Parse(pkcs7Certs)
-			if parseErr != nil {
-				pfxlog.Logger().Warnf("could not parse certificates. no certificates added from %s", urlRoot)
-				return nil
-			}
-			return certs.Certificates
+		certs, parseErr := est.ParsePKCS7Certificates(pkcs7b64)
+		if parseErr != nil {
+			pfxlog.Logger().Warnf("could not parse certificates. no certificates added from %s: %s", urlRoot, parseErr)
+			return nil
 		}
+		return certs
 	} else {
 		pfxlog.Logger().Debugf("no certificates added from url. http response: %d, url: %s", resp.StatusCode, urlRoot)
 	}
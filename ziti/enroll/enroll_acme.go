@@ -0,0 +1,282 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package enroll
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"strings"
+
+	"github.com/netfoundry/ziti-sdk-golang/ziti/config"
+	"github.com/openziti/foundation/identity/certtools"
+	"github.com/openziti/foundation/identity/identity"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme"
+)
+
+// HTTPSolver answers an ACME http-01 challenge for the given token/keyAuth pair. Implementations are
+// responsible for serving (or otherwise making reachable) the key authorization at
+// http://<domain>/.well-known/acme-challenge/<token> for the lifetime of the challenge.
+type HTTPSolver interface {
+	Present(domain, token, keyAuth string) error
+	CleanUp(domain, token, keyAuth string) error
+}
+
+// DNSSolver answers an ACME dns-01 challenge by publishing (and later removing) a TXT record at
+// _acme-challenge.<domain> containing the provided value. Consumers implement this against their own
+// DNS provider.
+type DNSSolver interface {
+	Present(domain, value string) error
+	CleanUp(domain, value string) error
+}
+
+// TLSALPNSolver answers an ACME tls-alpn-01 challenge. Most implementations run a TLS listener on
+// :443 that presents the supplied certificate for the duration of the challenge.
+type TLSALPNSolver interface {
+	Present(domain string, cert *tls.Certificate) error
+	CleanUp(domain string) error
+}
+
+func enrollACME(ctx context.Context, enFlags EnrollmentFlags, cfg *config.Config, caPool *x509.CertPool) error {
+	token := enFlags.Token
+	caPool = useSystemCasIfEmpty(caPool)
+
+	accountKey, err := acmeAccountKey(cfg)
+	if err != nil {
+		return errors.Errorf("failed to obtain acme account key: %s", err.Error())
+	}
+
+	client := &acme.Client{
+		Key:          accountKey,
+		DirectoryURL: token.ACMEDirectoryURL,
+		HTTPClient: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: caPool},
+			},
+		},
+	}
+
+	account, err := acmeRegisterOrLoadAccount(ctx, client, token, cfg)
+	if err != nil {
+		return errors.Errorf("acme account registration failed: %s", err.Error())
+	}
+	cfg.ACMEAccountURL = account.URI
+
+	if len(token.ACMEIdentifiers) == 0 {
+		return errors.New("enrollment token did not specify any ACMEIdentifiers to request a certificate for")
+	}
+	domains := token.ACMEIdentifiers
+	cn := domains[0]
+
+	authzIDs := make([]acme.AuthzID, 0, len(domains))
+	for _, d := range domains {
+		authzIDs = append(authzIDs, acme.AuthzID{Type: "dns", Value: d})
+	}
+
+	order, err := client.AuthorizeOrder(ctx, authzIDs)
+	if err != nil {
+		return errors.Errorf("failed to create acme order: %s", err.Error())
+	}
+
+	for _, authzURL := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, authzURL)
+		if err != nil {
+			return errors.Errorf("failed to fetch acme authorization: %s", err.Error())
+		}
+
+		if err := acmeSolveAuthorization(ctx, client, authz, token); err != nil {
+			return errors.Errorf("failed to solve acme challenge for %s: %s", authz.Identifier.Value, err.Error())
+		}
+	}
+
+	if _, err := client.WaitOrder(ctx, order.URI); err != nil {
+		return errors.Errorf("acme order did not become ready: %s", err.Error())
+	}
+
+	pk, err := resolveSigner(enFlags, cfg)
+	if err != nil {
+		return err
+	}
+
+	request, err := certtools.NewCertRequest(map[string]string{
+		"C": "US", "O": "NetFoundry", "CN": cn,
+	}, domains)
+	if err != nil {
+		return err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, request, pk)
+	if err != nil {
+		return err
+	}
+
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return errors.Errorf("acme finalize failed: %s", err.Error())
+	}
+	if len(der) == 0 {
+		return errors.New("acme order finalized but no certificate was returned")
+	}
+
+	cfg.ID.Cert = "pem:" + string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der[0]}))
+
+	if len(der) > 1 {
+		var chain []byte
+		for _, intermediateDer := range der[1:] {
+			chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: intermediateDer})...)
+		}
+		cfg.ID.CA = "pem:" + string(chain)
+	}
+
+	if accountKeyPem, err := acmeEncodeAccountKey(accountKey); err == nil {
+		cfg.ACMEAccountKey = "pem:" + string(accountKeyPem)
+	}
+
+	return nil
+}
+
+// acmeAccountKey returns the key used to authenticate to the ACME server, reusing a previously
+// persisted account key (see cfg.ACMEAccountKey) so renewals reuse the same account.
+func acmeAccountKey(cfg *config.Config) (crypto.Signer, error) {
+	if strings.TrimSpace(cfg.ACMEAccountKey) != "" {
+		key, err := identity.LoadKey(cfg.ACMEAccountKey)
+		if err == nil {
+			if signer, ok := key.(crypto.Signer); ok {
+				return signer, nil
+			}
+		}
+	}
+
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+func acmeEncodeAccountKey(key crypto.Signer) ([]byte, error) {
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("acme account key is not an ecdsa key")
+	}
+	asnBytes, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: asnBytes}), nil
+}
+
+func acmeRegisterOrLoadAccount(ctx context.Context, client *acme.Client, token *config.EnrollmentClaims, cfg *config.Config) (*acme.Account, error) {
+	if strings.TrimSpace(cfg.ACMEAccountURL) != "" {
+		account, err := client.GetReg(ctx, cfg.ACMEAccountURL)
+		if err == nil {
+			return account, nil
+		}
+	}
+
+	contact := []string{"mailto:" + token.ACMEAccountEmail}
+
+	if token.ACMEExternalAccountBindingKID != "" {
+		// golang.org/x/crypto/acme has no support for RFC 8555 section 7.3.4 external account
+		// binding (acme.Account has no ExternalAccountBinding field), so EAB-required CAs are
+		// registered by hand instead of going through client.Register.
+		return acmeRegisterWithEAB(ctx, client, token, contact)
+	}
+
+	account := &acme.Account{Contact: contact}
+	return client.Register(ctx, account, acme.AcceptTOS)
+}
+
+func acmeSolveAuthorization(ctx context.Context, client *acme.Client, authz *acme.Authorization, token *config.EnrollmentClaims) error {
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == token.ACMEChallengeType {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return errors.Errorf("server did not offer challenge type '%s' for %s", token.ACMEChallengeType, authz.Identifier.Value)
+	}
+
+	switch chal.Type {
+	case "http-01":
+		if token.ACMEHTTPSolver == nil {
+			return errors.New("http-01 challenge requested but no HTTPSolver configured")
+		}
+		keyAuth, err := client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return err
+		}
+		solver, ok := token.ACMEHTTPSolver.(HTTPSolver)
+		if !ok {
+			return errors.New("configured ACMEHTTPSolver does not implement HTTPSolver")
+		}
+		if err := solver.Present(authz.Identifier.Value, chal.Token, keyAuth); err != nil {
+			return err
+		}
+		defer func() { _ = solver.CleanUp(authz.Identifier.Value, chal.Token, keyAuth) }()
+	case "dns-01":
+		if token.ACMEDNSSolver == nil {
+			return errors.New("dns-01 challenge requested but no DNSSolver configured")
+		}
+		value, err := client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return err
+		}
+		solver, ok := token.ACMEDNSSolver.(DNSSolver)
+		if !ok {
+			return errors.New("configured ACMEDNSSolver does not implement DNSSolver")
+		}
+		if err := solver.Present(authz.Identifier.Value, value); err != nil {
+			return err
+		}
+		defer func() { _ = solver.CleanUp(authz.Identifier.Value, value) }()
+	case "tls-alpn-01":
+		if token.ACMETLSALPNSolver == nil {
+			return errors.New("tls-alpn-01 challenge requested but no TLSALPNSolver configured")
+		}
+		cert, err := client.TLSALPN01ChallengeCert(chal.Token, authz.Identifier.Value)
+		if err != nil {
+			return err
+		}
+		solver, ok := token.ACMETLSALPNSolver.(TLSALPNSolver)
+		if !ok {
+			return errors.New("configured ACMETLSALPNSolver does not implement TLSALPNSolver")
+		}
+		if err := solver.Present(authz.Identifier.Value, &cert); err != nil {
+			return err
+		}
+		defer func() { _ = solver.CleanUp(authz.Identifier.Value) }()
+	default:
+		return errors.Errorf("unsupported acme challenge type: %s", chal.Type)
+	}
+
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return err
+	}
+
+	_, err := client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
@@ -0,0 +1,230 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package enroll
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+
+	"github.com/netfoundry/ziti-sdk-golang/ziti/config"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme"
+)
+
+// acmeRegisterWithEAB performs RFC 8555 section 7.3.4 external account binding registration, which
+// the vendored golang.org/x/crypto/acme client does not implement (acme.Account has no
+// ExternalAccountBinding field). It signs the newAccount request by hand using client.Key (required
+// to be an ECDSA P-256 key) and submits it directly to the CA's newAccount endpoint.
+func acmeRegisterWithEAB(ctx context.Context, client *acme.Client, token *config.EnrollmentClaims, contact []string) (*acme.Account, error) {
+	ecKey, ok := client.Key.(*ecdsa.PrivateKey)
+	if !ok || ecKey.Curve.Params().Name != "P-256" {
+		return nil, errors.New("external account binding requires an ECDSA P-256 account key")
+	}
+
+	dir, err := client.Discover(ctx)
+	if err != nil {
+		return nil, errors.Errorf("acme directory discovery failed: %s", err.Error())
+	}
+
+	nonce, err := acmeFetchNonce(ctx, client.HTTPClient, dir.NonceURL)
+	if err != nil {
+		return nil, errors.Errorf("could not obtain a replay-nonce: %s", err.Error())
+	}
+
+	jwk := acmeJWK(&ecKey.PublicKey)
+
+	eabJWS, err := acmeSignEAB(jwk, token.ACMEExternalAccountBindingKID, token.ACMEExternalAccountBindingHMAC, dir.RegURL)
+	if err != nil {
+		return nil, errors.Errorf("could not build external account binding: %s", err.Error())
+	}
+
+	payload, err := json.Marshal(struct {
+		TermsAgreed bool            `json:"termsOfServiceAgreed"`
+		Contact     []string        `json:"contact,omitempty"`
+		EAB         json.RawMessage `json:"externalAccountBinding"`
+	}{
+		TermsAgreed: true,
+		Contact:     contact,
+		EAB:         eabJWS,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := acmeSignJWS(ecKey, jwk, nonce, dir.RegURL, payload)
+	if err != nil {
+		return nil, errors.Errorf("could not sign newAccount request: %s", err.Error())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dir.RegURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		return nil, errors.Errorf("newAccount request failed: %s", err.Error())
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, errors.Errorf("newAccount request failed: %s", resp.Status)
+	}
+
+	var wireAccount struct {
+		Status  string   `json:"status"`
+		Contact []string `json:"contact"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&wireAccount); err != nil {
+		return nil, errors.Errorf("could not parse newAccount response: %s", err.Error())
+	}
+
+	return &acme.Account{
+		URI:     resp.Header.Get("Location"),
+		Contact: wireAccount.Contact,
+		Status:  wireAccount.Status,
+	}, nil
+}
+
+// acmeFetchNonce retrieves a fresh replay-nonce via HEAD, as recommended by RFC 8555 section 7.2.
+func acmeFetchNonce(ctx context.Context, httpClient *http.Client, nonceURL string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, nonceURL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("server did not return a Replay-Nonce header")
+	}
+	return nonce, nil
+}
+
+// acmeJWK encodes pub as a JSON Web Key, per RFC 7518 section 6.2.
+func acmeJWK(pub *ecdsa.PublicKey) json.RawMessage {
+	size := (pub.Curve.Params().BitSize + 7) / 8
+	jwk, _ := json.Marshal(struct {
+		Kty string `json:"kty"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(bigIntToFixedBytes(pub.X, size)),
+		Y:   base64.RawURLEncoding.EncodeToString(bigIntToFixedBytes(pub.Y, size)),
+	})
+	return jwk
+}
+
+// acmeSignEAB builds the inner, HMAC-signed JWS required by RFC 8555 section 7.3.4: its payload is
+// the account's JWK, its protected header carries the EAB key identifier provided out-of-band by the
+// CA, and it is signed with the EAB HMAC key (base64url encoded, as CAs conventionally distribute it).
+func acmeSignEAB(accountJWK json.RawMessage, kid, hmacKeyB64 string, url string) (json.RawMessage, error) {
+	hmacKey, err := base64.RawURLEncoding.DecodeString(hmacKeyB64)
+	if err != nil {
+		return nil, errors.Errorf("external account binding hmac key is not valid base64url: %s", err.Error())
+	}
+
+	protected, err := json.Marshal(struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+		URL string `json:"url"`
+	}{Alg: "HS256", Kid: kid, URL: url})
+	if err != nil {
+		return nil, err
+	}
+
+	protectedB64 := base64.RawURLEncoding.EncodeToString(protected)
+	payloadB64 := base64.RawURLEncoding.EncodeToString(accountJWK)
+
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write([]byte(protectedB64 + "." + payloadB64))
+	sig := mac.Sum(nil)
+
+	return json.Marshal(struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}{
+		Protected: protectedB64,
+		Payload:   payloadB64,
+		Signature: base64.RawURLEncoding.EncodeToString(sig),
+	})
+}
+
+// acmeSignJWS builds the outer, account-key-signed (ES256) JWS carrying payload to url.
+func acmeSignJWS(key *ecdsa.PrivateKey, jwk json.RawMessage, nonce, url string, payload []byte) ([]byte, error) {
+	protected, err := json.Marshal(struct {
+		Alg   string          `json:"alg"`
+		JWK   json.RawMessage `json:"jwk"`
+		Nonce string          `json:"nonce"`
+		URL   string          `json:"url"`
+	}{Alg: "ES256", JWK: jwk, Nonce: nonce, URL: url})
+	if err != nil {
+		return nil, err
+	}
+
+	protectedB64 := base64.RawURLEncoding.EncodeToString(protected)
+	payloadB64 := base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(protectedB64 + "." + payloadB64))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	size := (key.Curve.Params().BitSize + 7) / 8
+	sig := append(bigIntToFixedBytes(r, size), bigIntToFixedBytes(s, size)...)
+
+	return json.Marshal(struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}{
+		Protected: protectedB64,
+		Payload:   payloadB64,
+		Signature: base64.RawURLEncoding.EncodeToString(sig),
+	})
+}
+
+// bigIntToFixedBytes left-pads n's big-endian bytes to size, as required for JWK/JWS coordinate and
+// signature encoding (big.Int.Bytes strips leading zeroes, which would shorten the field).
+func bigIntToFixedBytes(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	if len(b) == size {
+		return b
+	}
+	out := make([]byte, size)
+	copy(out[size-len(b):], b)
+	return out
+}
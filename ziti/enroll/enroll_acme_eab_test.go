@@ -0,0 +1,151 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package enroll
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBigIntToFixedBytes(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int64
+		size int
+		want []byte
+	}{
+		{"pads short value", 1, 4, []byte{0, 0, 0, 1}},
+		{"exact width unchanged", 0x0102, 2, []byte{0x01, 0x02}},
+		{"zero pads to all zeroes", 0, 3, []byte{0, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := bigIntToFixedBytes(big.NewInt(tt.n), tt.size)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestAcmeJWK_FixedWidthCoordinates(t *testing.T) {
+	// Coordinates (not a point on the curve; acmeJWK only encodes them) whose X begins with a zero
+	// byte, so big.Int.Bytes() alone would produce a short field if bigIntToFixedBytes' padding
+	// were broken.
+	x, _ := new(big.Int).SetString("00d1f8c2f470070b6114aa4010bf986c4c29a6a2e26bb76cda019828f61a1c0f", 16)
+	y, _ := new(big.Int).SetString("c84cc43468d2f2eecb67e2f5d7e8f0a2b2a2f6478cc8a1a6f7e7d5c6b5a4938e", 16)
+	pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+
+	jwk := acmeJWK(pub)
+
+	var decoded struct {
+		Kty string `json:"kty"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+	require.NoError(t, json.Unmarshal(jwk, &decoded))
+	require.Equal(t, "EC", decoded.Kty)
+	require.Equal(t, "P-256", decoded.Crv)
+
+	xBytes, err := base64.RawURLEncoding.DecodeString(decoded.X)
+	require.NoError(t, err)
+	require.Len(t, xBytes, 32)
+	require.Equal(t, x, new(big.Int).SetBytes(xBytes))
+
+	yBytes, err := base64.RawURLEncoding.DecodeString(decoded.Y)
+	require.NoError(t, err)
+	require.Len(t, yBytes, 32)
+	require.Equal(t, y, new(big.Int).SetBytes(yBytes))
+}
+
+func TestAcmeSignEAB_ProducesVerifiableJWS(t *testing.T) {
+	accountJWK := json.RawMessage(`{"kty":"EC","crv":"P-256","x":"abc","y":"def"}`)
+	hmacKey := []byte("this is a known eab hmac key!!!")
+	hmacKeyB64 := base64.RawURLEncoding.EncodeToString(hmacKey)
+
+	out, err := acmeSignEAB(accountJWK, "kid-1", hmacKeyB64, "https://ca.example/acme/new-account")
+	require.NoError(t, err)
+
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}
+	require.NoError(t, json.Unmarshal(out, &jws))
+
+	protectedJSON, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	require.NoError(t, err)
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+		URL string `json:"url"`
+	}
+	require.NoError(t, json.Unmarshal(protectedJSON, &header))
+	require.Equal(t, "HS256", header.Alg)
+	require.Equal(t, "kid-1", header.Kid)
+	require.Equal(t, "https://ca.example/acme/new-account", header.URL)
+
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	require.NoError(t, err)
+	require.JSONEq(t, string(accountJWK), string(payload))
+
+	// Recompute the HMAC independently, over the same signing input the JWS spec defines
+	// (base64url(protected) + "." + base64url(payload)), and confirm it matches.
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write([]byte(jws.Protected + "." + jws.Payload))
+	wantSig := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	require.Equal(t, wantSig, jws.Signature)
+}
+
+func TestAcmeSignJWS_ProducesVerifiableSignature(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	jwk := acmeJWK(&key.PublicKey)
+	payload := []byte(`{"contact":["mailto:test@example.com"]}`)
+
+	out, err := acmeSignJWS(key, jwk, "nonce-123", "https://ca.example/acme/new-account", payload)
+	require.NoError(t, err)
+
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}
+	require.NoError(t, json.Unmarshal(out, &jws))
+
+	sig, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	require.NoError(t, err)
+	require.Len(t, sig, 64)
+
+	size := 32
+	r := new(big.Int).SetBytes(sig[:size])
+	s := new(big.Int).SetBytes(sig[size:])
+
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	require.True(t, ecdsa.Verify(&key.PublicKey, digest[:], r, s))
+}
@@ -0,0 +1,322 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package enroll
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/netfoundry/ziti-sdk-golang/ziti/config"
+	"github.com/openziti/foundation/identity/certtools"
+	"github.com/pkg/errors"
+)
+
+const (
+	awsIMDSTokenURL   = "http://169.254.169.254/latest/api/token"
+	awsIIDDocURL      = "http://169.254.169.254/latest/dynamic/instance-identity/document"
+	awsIIDSigURL      = "http://169.254.169.254/latest/dynamic/instance-identity/signature"
+	azureMSITokenURL  = "http://169.254.169.254/metadata/identity/oauth2/token"
+	gcpIdentityMDURL  = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/identity"
+	imdsClientTimeout = 5 * time.Second
+)
+
+// azureManagedIdentityPattern matches the xms_mirid claim of an Azure AD managed identity token
+// against either a VM-bound or user-assigned managed identity resource ID.
+var azureManagedIdentityPattern = regexp.MustCompile(`/providers/Microsoft\.(Compute/virtualMachines|ManagedIdentity/userAssignedIdentities)/`)
+
+// cloudEnrollPayload is submitted alongside a CSR to the controller's enrollment URL for every
+// cloud-identity-backed method; the controller validates Document/Signature (aws), IDToken
+// (azure/gcp) against the respective cloud provider before issuing a certificate.
+type cloudEnrollPayload struct {
+	CSR       string `json:"csr"`
+	Document  string `json:"document,omitempty"`  // aws: base64 instance identity document
+	Signature string `json:"signature,omitempty"` // aws: base64 RSA-SHA256 signature of Document
+	IDToken   string `json:"idToken,omitempty"`   // azure/gcp: bearer JWT proving instance identity
+}
+
+func enrollAWS(ctx context.Context, enFlags EnrollmentFlags, cfg *config.Config, caPool *x509.CertPool) error {
+	token := enFlags.Token
+
+	httpClient := &http.Client{Timeout: imdsClientTimeout}
+
+	tokenReq, err := http.NewRequestWithContext(ctx, http.MethodPut, awsIMDSTokenURL, nil)
+	if err != nil {
+		return err
+	}
+	tokenReq.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+
+	tokenResp, err := httpClient.Do(tokenReq)
+	if err != nil {
+		return errors.Errorf("could not fetch aws imdsv2 token: %s", err.Error())
+	}
+	imdsToken, err := readOKBody(tokenResp)
+	if err != nil {
+		return errors.Errorf("could not fetch aws imdsv2 token: %s", err.Error())
+	}
+
+	document, err := fetchWithIMDSToken(ctx, httpClient, awsIIDDocURL, imdsToken)
+	if err != nil {
+		return errors.Errorf("could not fetch aws instance identity document: %s", err.Error())
+	}
+
+	signature, err := fetchWithIMDSToken(ctx, httpClient, awsIIDSigURL, imdsToken)
+	if err != nil {
+		return errors.Errorf("could not fetch aws instance identity signature: %s", err.Error())
+	}
+
+	csr, err := buildCSR(enFlags, cfg)
+	if err != nil {
+		return err
+	}
+
+	payload := cloudEnrollPayload{
+		CSR:      base64.StdEncoding.EncodeToString(csr),
+		Document: base64.StdEncoding.EncodeToString(document),
+		// the IMDS signature endpoint already returns a base64-encoded RSA-SHA256 signature;
+		// re-encoding it here would double-encode it and the controller would fail to verify it.
+		Signature: strings.TrimSpace(string(signature)),
+	}
+
+	return postCloudEnrollment(ctx, token, cfg, caPool, payload)
+}
+
+func enrollAzure(ctx context.Context, enFlags EnrollmentFlags, cfg *config.Config, caPool *x509.CertPool) error {
+	token := enFlags.Token
+
+	u, err := url.Parse(azureMSITokenURL)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("api-version", "2018-02-01")
+	q.Set("resource", token.CloudAudience)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Metadata", "true")
+
+	httpClient := &http.Client{Timeout: imdsClientTimeout}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return errors.Errorf("could not fetch azure msi token: %s", err.Error())
+	}
+
+	body, err := readOKBody(resp)
+	if err != nil {
+		return errors.Errorf("could not fetch azure msi token: %s", err.Error())
+	}
+
+	var msiResp struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(body, &msiResp); err != nil {
+		return errors.Errorf("could not parse azure msi response: %s", err.Error())
+	}
+
+	if err := validateAzureManagedIdentity(msiResp.AccessToken); err != nil {
+		return errors.Errorf("azure msi token rejected: %s", err.Error())
+	}
+
+	csr, err := buildCSR(enFlags, cfg)
+	if err != nil {
+		return err
+	}
+
+	payload := cloudEnrollPayload{
+		CSR:     base64.StdEncoding.EncodeToString(csr),
+		IDToken: msiResp.AccessToken,
+	}
+
+	return postCloudEnrollment(ctx, token, cfg, caPool, payload)
+}
+
+// validateAzureManagedIdentity decodes accessToken's payload and checks that its xms_mirid claim
+// identifies a VM-bound or user-assigned managed identity, rejecting tokens minted for unrelated
+// Azure AD principals before they're ever sent to the controller.
+func validateAzureManagedIdentity(accessToken string) error {
+	parts := strings.Split(accessToken, ".")
+	if len(parts) != 3 {
+		return errors.New("access token is not a valid JWT")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return errors.Errorf("could not decode access token payload: %s", err.Error())
+	}
+
+	var claims struct {
+		MIRID string `json:"xms_mirid"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return errors.Errorf("could not parse access token claims: %s", err.Error())
+	}
+
+	if !azureManagedIdentityPattern.MatchString(claims.MIRID) {
+		return errors.Errorf("xms_mirid claim %q does not identify a vm or user-assigned managed identity", claims.MIRID)
+	}
+	return nil
+}
+
+func enrollGCP(ctx context.Context, enFlags EnrollmentFlags, cfg *config.Config, caPool *x509.CertPool) error {
+	token := enFlags.Token
+
+	u, err := url.Parse(gcpIdentityMDURL)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("audience", token.CloudAudience)
+	q.Set("format", "full")
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	httpClient := &http.Client{Timeout: imdsClientTimeout}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return errors.Errorf("could not fetch gcp identity token: %s", err.Error())
+	}
+
+	idToken, err := readOKBody(resp)
+	if err != nil {
+		return errors.Errorf("could not fetch gcp identity token: %s", err.Error())
+	}
+
+	csr, err := buildCSR(enFlags, cfg)
+	if err != nil {
+		return err
+	}
+
+	payload := cloudEnrollPayload{
+		CSR:     base64.StdEncoding.EncodeToString(csr),
+		IDToken: string(idToken),
+	}
+
+	return postCloudEnrollment(ctx, token, cfg, caPool, payload)
+}
+
+// buildCSR signs a CSR for this host using the key staged in cfg.ID.Key, identical to enrollOTT.
+func buildCSR(enFlags EnrollmentFlags, cfg *config.Config) ([]byte, error) {
+	pk, err := resolveSigner(enFlags, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := certtools.NewCertRequest(map[string]string{
+		"C": "US", "O": "NetFoundry", "CN": hostname,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.CreateCertificateRequest(rand.Reader, request, pk)
+}
+
+func postCloudEnrollment(ctx context.Context, token *config.EnrollmentClaims, cfg *config.Config, caPool *x509.CertPool, payload cloudEnrollPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	caPool = useSystemCasIfEmpty(caPool)
+	client := http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: caPool},
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, token.EnrolmentUrl(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	respBody, err := readBody(resp)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("enroll error: %s: %s", resp.Status, respBody)
+	}
+
+	cfg.ID.Cert = "pem:" + string(respBody)
+	return nil
+}
+
+func readBody(resp *http.Response) ([]byte, error) {
+	defer func() { _ = resp.Body.Close() }()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// readOKBody is like readBody but treats any non-200 response as an error, folding the (likely
+// short, plain-text) error body into the message. Used for the cloud metadata/IMDS endpoints,
+// which silently return 401/404 error pages rather than the token/document/signature they were
+// asked for.
+func readOKBody(resp *http.Response) ([]byte, error) {
+	body, err := readBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("%s: %s", resp.Status, body)
+	}
+	return body, nil
+}
+
+func fetchWithIMDSToken(ctx context.Context, client *http.Client, endpoint string, token []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	return readOKBody(resp)
+}
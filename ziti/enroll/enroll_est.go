@@ -0,0 +1,100 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package enroll
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+
+	"github.com/netfoundry/ziti-sdk-golang/ziti/config"
+	"github.com/netfoundry/ziti-sdk-golang/ziti/enroll/est"
+	"github.com/openziti/foundation/identity/certtools"
+	"github.com/pkg/errors"
+)
+
+// enrollEST enrolls cfg against any RFC 7030-compliant CA (e.g. step-ca's EST provisioner) reachable
+// at token.EnrolmentUrl(), honoring server-mandated CSR attributes before signing.
+func enrollEST(ctx context.Context, enFlags EnrollmentFlags, cfg *config.Config, caPool *x509.CertPool) error {
+	token := enFlags.Token
+
+	pk, err := resolveSigner(enFlags, cfg)
+	if err != nil {
+		return err
+	}
+
+	caPool = useSystemCasIfEmpty(caPool)
+	client := est.NewClient(token.EnrolmentUrl(), caPool)
+	client.Username = token.ESTUsername
+	client.Password = token.ESTPassword
+	client.Base64Encode = token.ESTBase64Encode
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	subjectAttrs := map[string]string{"C": "US", "O": "NetFoundry", "CN": hostname}
+	var sans []string
+
+	if attrs, err := client.CSRAttrs(ctx); err != nil {
+		return errors.Errorf("est csrattrs request failed: %s", err.Error())
+	} else if attrs != nil {
+		if attrs.Requests(oidSubjectAltName) {
+			// the server asked for a subjectAltName with no specific values - it wants this
+			// host's own identity reflected back as a DNS SAN.
+			sans = append(sans, hostname)
+		}
+		sans = append(sans, attrs.Attributes[oidSubjectAltName]...)
+	}
+
+	request, err := certtools.NewCertRequest(subjectAttrs, sans)
+	if err != nil {
+		return err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, request, pk)
+	if err != nil {
+		return err
+	}
+
+	certs, err := client.SimpleEnroll(ctx, csr)
+	if err != nil {
+		return errors.Errorf("est enroll error: %s", err.Error())
+	}
+	if len(certs) == 0 {
+		return errors.New("est server returned no certificates")
+	}
+
+	cfg.ID.Cert = "pem:" + string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certs[0].Raw}))
+
+	if len(certs) > 1 {
+		var chain []byte
+		for _, intermediate := range certs[1:] {
+			chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: intermediate.Raw})...)
+		}
+		cfg.ID.CA = "pem:" + string(chain)
+	}
+
+	return nil
+}
+
+// oidSubjectAltName is the dotted OID (2.5.29.17) EST servers use in /csrattrs to request that the
+// CSR carry one or more subjectAltName values.
+const oidSubjectAltName = "2.5.29.17"
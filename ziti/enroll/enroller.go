@@ -0,0 +1,245 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package enroll
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/netfoundry/ziti-sdk-golang/ziti/config"
+)
+
+// KeyGenerated is emitted once cfg.ID.Key has been created (and, if configured, persisted) but
+// before any network call has been made.
+type KeyGenerated struct {
+	KeyURI string
+}
+
+// CAsFetched is emitted after a retry round-trips to the server to fetch additional trusted
+// certificates following an UnknownAuthority error.
+type CAsFetched struct {
+	Count int
+}
+
+// CSRSubmitted is emitted once the enrollment method's CSR/request has been accepted by the server.
+type CSRSubmitted struct {
+	Method string
+}
+
+// CertificateIssued is emitted once Enroll has successfully produced a config.Config.
+type CertificateIssued struct {
+	Cert string
+}
+
+// Retry is emitted each time a TLS-authority retry is attempted.
+type Retry struct {
+	Err     error
+	Attempt int
+}
+
+// EventHandler receives enrollment progress events. Handlers are invoked synchronously on the
+// goroutine calling Enroll, so a handler that renders progress or logs should not block.
+type EventHandler func(event interface{})
+
+// Enroller drives a single enrollment to completion. Unlike the package-level Enroll function, it
+// is context-aware and cancellable, reports progress via an EventHandler, and can persist generated
+// key material before the first network call so a crashed enrollment can resume with the same key.
+type Enroller struct {
+	flags        EnrollmentFlags
+	eventHandler EventHandler
+	retryBackoff backoff.BackOff
+	maxAttempts  int
+	keyWriter    io.Writer
+	keyPath      string
+}
+
+// Option configures an Enroller built by NewEnroller.
+type Option func(*Enroller)
+
+// WithFlags sets the EnrollmentFlags to enroll with. Required.
+func WithFlags(flags EnrollmentFlags) Option {
+	return func(e *Enroller) { e.flags = flags }
+}
+
+// WithEventHandler registers a callback invoked with each typed progress event
+// (KeyGenerated, CAsFetched, CSRSubmitted, CertificateIssued, Retry).
+func WithEventHandler(handler EventHandler) Option {
+	return func(e *Enroller) { e.eventHandler = handler }
+}
+
+// WithBackOff overrides the backoff.BackOff used to space out TLS-authority retries. Defaults to a
+// backoff.NewExponentialBackOff() capped by WithMaxAttempts.
+func WithBackOff(b backoff.BackOff) Option {
+	return func(e *Enroller) { e.retryBackoff = b }
+}
+
+// WithMaxAttempts caps how many times Enroll will retry after an UnknownAuthority TLS error before
+// giving up and returning that error. Defaults to 1, matching the SDK's historical two-pass
+// behavior.
+func WithMaxAttempts(n int) Option {
+	return func(e *Enroller) { e.maxAttempts = n }
+}
+
+// WithKeyPersistence writes the generated private key to path before the first network call is
+// made, so a crashed or interrupted enrollment can be retried without regenerating (and orphaning,
+// server-side) a new key. Ignored whenever EnrollmentFlags.KeyFile is set.
+func WithKeyPersistence(path string) Option {
+	return func(e *Enroller) { e.keyPath = path }
+}
+
+// WithKeyWriter is like WithKeyPersistence but writes to an arbitrary io.Writer instead of a path,
+// for callers that manage their own storage.
+func WithKeyWriter(w io.Writer) Option {
+	return func(e *Enroller) { e.keyWriter = w }
+}
+
+// NewEnroller builds an Enroller, applying opts over the documented defaults.
+func NewEnroller(opts ...Option) *Enroller {
+	e := &Enroller{
+		maxAttempts: 1,
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	if e.retryBackoff == nil {
+		b := backoff.NewExponentialBackOff()
+		b.MaxElapsedTime = 0
+		e.retryBackoff = b
+	}
+	return e
+}
+
+// Enroll runs e.flags through to completion or until ctx is cancelled, emitting progress events as
+// it goes.
+func (e *Enroller) Enroll(ctx context.Context) (*config.Config, error) {
+	return e.enroll(ctx)
+}
+
+func (e *Enroller) emit(event interface{}) {
+	if e.eventHandler != nil {
+		e.eventHandler(event)
+	}
+}
+
+// pemKeyURIPrefix is the "pem:" scheme kms.Software uses for its KeyURI, identical to
+// identity.StoragePem.
+const pemKeyURIPrefix = "pem:"
+
+// persistKey writes keyURI to e.keyWriter / e.keyPath before any network call is made, so a
+// crashed or interrupted enrollment can resume with the same key (see resumeKey) instead of
+// regenerating, and orphaning server-side, a new one. When keyURI uses the "pem:" scheme (the
+// common software-generated case) only the bare PEM is written to e.keyPath, so the file
+// round-trips through the same file:// convention used for a user-supplied KeyFile; other schemes
+// (HSM/KMS key references) are written verbatim.
+func (e *Enroller) persistKey(keyURI string) error {
+	if e.keyWriter != nil {
+		if _, err := e.keyWriter.Write([]byte(keyURI)); err != nil {
+			return err
+		}
+	}
+
+	if e.keyPath == "" {
+		return nil
+	}
+
+	data := []byte(keyURI)
+	if strings.HasPrefix(keyURI, pemKeyURIPrefix) {
+		data = []byte(strings.TrimPrefix(keyURI, pemKeyURIPrefix))
+	}
+
+	dir := filepath.Dir(e.keyPath)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(e.keyPath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmpName)
+		return err
+	}
+	if err := os.Chmod(tmpName, 0600); err != nil {
+		_ = os.Remove(tmpName)
+		return err
+	}
+	return os.Rename(tmpName, e.keyPath)
+}
+
+// resumeKey loads a key persisted by an earlier, interrupted call to persistKey, if one is
+// present at e.keyPath: a persisted PEM key is treated exactly like a user-supplied KeyFile (see
+// stageKey), and a persisted HSM/KMS KeyURI is used as cfg.ID.Key again as-is. It reports
+// false, nil when there is nothing to resume, so the caller falls through to generating a fresh
+// key.
+func (e *Enroller) resumeKey(cfg *config.Config) (bool, error) {
+	if e.keyPath == "" {
+		return false, nil
+	}
+
+	stat, err := os.Stat(e.keyPath)
+	if err != nil || stat.IsDir() {
+		return false, nil
+	}
+
+	data, err := ioutil.ReadFile(e.keyPath)
+	if err != nil {
+		return false, err
+	}
+	if stored := strings.TrimSpace(string(data)); stored != "" && !strings.HasPrefix(stored, "-----BEGIN") {
+		cfg.ID.Key = stored
+		e.emit(KeyGenerated{KeyURI: cfg.ID.Key})
+		return true, nil
+	}
+
+	absPath, err := filepath.Abs(e.keyPath)
+	if err != nil {
+		return false, err
+	}
+	cfg.ID.Key = "file://" + absPath
+	e.emit(KeyGenerated{KeyURI: cfg.ID.Key})
+	return true, nil
+}
+
+// wait pauses for e.retryBackoff's next interval, respecting ctx cancellation.
+func (e *Enroller) wait(ctx context.Context) error {
+	d := e.retryBackoff.NextBackOff()
+	if d == backoff.Stop {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
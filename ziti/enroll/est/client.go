@@ -0,0 +1,237 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package est implements the subset of RFC 7030 (Enrollment over Secure Transport) required to
+// enroll and renew a ziti identity against a third-party EST CA, such as step-ca's EST provisioner.
+package est
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/fullsailor/pkcs7"
+	"github.com/pkg/errors"
+)
+
+// Client is a minimal RFC 7030 EST client supporting /cacerts, /simpleenroll, /simplereenroll and
+// /csrattrs.
+type Client struct {
+	// BaseURL is the EST server root, e.g. https://est.example.com/.well-known/est
+	BaseURL string
+
+	// HTTPClient is used for every request. Callers are expected to configure TLSClientConfig
+	// (RootCAs and, for client-cert authentication, Certificates) before first use.
+	HTTPClient *http.Client
+
+	// Username and Password, when either is non-empty, are sent as HTTP Basic credentials.
+	Username string
+	Password string
+
+	// Base64Encode requests Content-Transfer-Encoding: base64 on enrollment requests, per
+	// section 3.2.2 of RFC 7030.
+	Base64Encode bool
+}
+
+// NewClient builds an EST client that trusts caPool (or the system pool if caPool is nil).
+func NewClient(baseURL string, caPool *x509.CertPool) *Client {
+	return &Client{
+		BaseURL: baseURL,
+		HTTPClient: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: caPool},
+			},
+		},
+	}
+}
+
+// WithClientCert configures the client to authenticate enrollment requests (typically
+// /simplereenroll) with the given certificate instead of, or in addition to, Basic auth.
+func (c *Client) WithClientCert(cert tls.Certificate) *Client {
+	transport := c.transport()
+	transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	return c
+}
+
+func (c *Client) transport() *http.Transport {
+	if c.HTTPClient == nil {
+		c.HTTPClient = &http.Client{}
+	}
+	transport, ok := c.HTTPClient.Transport.(*http.Transport)
+	if !ok || transport == nil {
+		transport = &http.Transport{TLSClientConfig: &tls.Config{}}
+		c.HTTPClient.Transport = transport
+	}
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	return transport
+}
+
+func (c *Client) endpoint(op string) (string, error) {
+	u, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return "", errors.Errorf("invalid est base url '%s': %s", c.BaseURL, err.Error())
+	}
+	u.Path = path.Join(u.Path, op)
+	return u.String(), nil
+}
+
+// CACerts implements GET /cacerts: the full CA certificate chain, returned PKCS#7 degenerate and
+// base64 encoded.
+func (c *Client) CACerts(ctx context.Context) ([]*x509.Certificate, error) {
+	endpoint, err := c.endpoint("cacerts")
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, errors.Errorf("est cacerts request failed: %s", err.Error())
+	}
+	defer closeBody(resp)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Errorf("est cacerts: could not read body: %s", err.Error())
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("est cacerts error: %s", resp.Status)
+	}
+
+	return ParsePKCS7Certificates(body)
+}
+
+// SimpleEnroll implements POST /simpleenroll: submit a PKCS#10 CSR, authenticated via Basic auth
+// (for a first-time, non-mTLS enrollment), and receive the issued certificate chain PKCS#7/base64
+// encoded.
+func (c *Client) SimpleEnroll(ctx context.Context, csrDER []byte) ([]*x509.Certificate, error) {
+	return c.enroll(ctx, "simpleenroll", csrDER)
+}
+
+// SimpleReenroll implements POST /simplereenroll: identical wire format to SimpleEnroll, but
+// authenticated with the certificate being renewed (see WithClientCert) per RFC 7030 section 4.2.2.
+func (c *Client) SimpleReenroll(ctx context.Context, csrDER []byte) ([]*x509.Certificate, error) {
+	return c.enroll(ctx, "simplereenroll", csrDER)
+}
+
+func (c *Client) enroll(ctx context.Context, op string, csrDER []byte) ([]*x509.Certificate, error) {
+	endpoint, err := c.endpoint(op)
+	if err != nil {
+		return nil, err
+	}
+
+	body := []byte(base64.StdEncoding.EncodeToString(csrDER))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/pkcs10")
+	if c.Base64Encode {
+		req.Header.Set("Content-Transfer-Encoding", "base64")
+	}
+	if c.Username != "" || c.Password != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, errors.Errorf("est %s request failed: %s", op, err.Error())
+	}
+	defer closeBody(resp)
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Errorf("est %s: could not read body: %s", op, err.Error())
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("est %s error: %s: %s", op, resp.Status, respBody)
+	}
+
+	return ParsePKCS7Certificates(respBody)
+}
+
+// CSRAttrs implements GET /csrattrs: the set of OIDs/attributes the server expects a CSR to carry.
+// A nil, nil return means the server does not publish CSR attributes, which RFC 7030 treats as
+// optional.
+func (c *Client) CSRAttrs(ctx context.Context) (*CSRAttrs, error) {
+	endpoint, err := c.endpoint("csrattrs")
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, errors.Errorf("est csrattrs request failed: %s", err.Error())
+	}
+	defer closeBody(resp)
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Errorf("est csrattrs: could not read body: %s", err.Error())
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("est csrattrs error: %s", resp.Status)
+	}
+
+	return ParseCSRAttrs(body)
+}
+
+// ParsePKCS7Certificates decodes a base64-wrapped, DER-encoded PKCS#7 "degenerate" certs-only
+// message as returned by /cacerts, /simpleenroll and /simplereenroll.
+func ParsePKCS7Certificates(base64Body []byte) ([]*x509.Certificate, error) {
+	der, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(base64Body)))
+	if err != nil {
+		return nil, errors.Errorf("could not base64 decode pkcs7 response: %s", err.Error())
+	}
+
+	p7, err := pkcs7.Parse(der)
+	if err != nil {
+		return nil, errors.Errorf("could not parse pkcs7 response: %s", err.Error())
+	}
+
+	return p7.Certificates, nil
+}
+
+func closeBody(resp *http.Response) {
+	if resp != nil && resp.Body != nil {
+		_ = resp.Body.Close()
+	}
+}
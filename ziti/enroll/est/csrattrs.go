@@ -0,0 +1,107 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package est
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/base64"
+
+	"github.com/pkg/errors"
+)
+
+// CSRAttrs is the decoded form of the RFC 7030 section 4.5.2 CsrAttrs SEQUENCE returned by
+// GET /csrattrs. Each entry is either a bare OID, meaning the CA requires that attribute present
+// with no specific value (collected in OIDs), or an OID with one or more specific values the CA
+// requires (collected in Attributes, keyed by the dotted OID string).
+type CSRAttrs struct {
+	OIDs       []asn1.ObjectIdentifier
+	Attributes map[string][]string
+}
+
+// Requests reports whether dottedOID appears in attrs.OIDs - i.e. the CA asked for that attribute
+// with no specific value attached, leaving the value up to this client.
+func (attrs *CSRAttrs) Requests(dottedOID string) bool {
+	for _, oid := range attrs.OIDs {
+		if oid.String() == dottedOID {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCSRAttrs decodes a base64-wrapped DER CsrAttrs SEQUENCE.
+func ParseCSRAttrs(base64Body []byte) (*CSRAttrs, error) {
+	der, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(base64Body)))
+	if err != nil {
+		return nil, errors.Errorf("could not base64 decode csrattrs response: %s", err.Error())
+	}
+
+	var rawSeq []asn1.RawValue
+	if _, err := asn1.Unmarshal(der, &rawSeq); err != nil {
+		return nil, errors.Errorf("could not parse csrattrs response: %s", err.Error())
+	}
+
+	attrs := &CSRAttrs{Attributes: map[string][]string{}}
+
+	for _, raw := range rawSeq {
+		var oid asn1.ObjectIdentifier
+		if _, err := asn1.Unmarshal(raw.FullBytes, &oid); err == nil {
+			attrs.OIDs = append(attrs.OIDs, oid)
+			continue
+		}
+
+		var seq struct {
+			Type   asn1.ObjectIdentifier
+			Values []asn1.RawValue `asn1:"set"`
+		}
+		if _, err := asn1.Unmarshal(raw.FullBytes, &seq); err != nil {
+			return nil, errors.Errorf("could not parse csrattrs entry: %s", err.Error())
+		}
+
+		values := make([]string, 0, len(seq.Values))
+		for _, v := range seq.Values {
+			value, err := decodeAttributeValue(v)
+			if err != nil {
+				return nil, errors.Errorf("could not parse csrattrs value for %s: %s", seq.Type.String(), err.Error())
+			}
+			values = append(values, value)
+		}
+		attrs.Attributes[seq.Type.String()] = values
+	}
+
+	return attrs, nil
+}
+
+// decodeAttributeValue decodes a single AttributeValue per its actual ASN.1 tag, rather than
+// assuming its content bytes are already a usable string: v.Bytes holds only the raw content, so a
+// string-typed value (IA5String, UTF8String, PrintableString, T61String) decodes straight to a Go
+// string, while any other tag is passed to asn1.Unmarshal into a string. That succeeds only for
+// the other string types encoding/asn1 accepts; any other value (e.g. a GeneralName choice)
+// returns an error.
+func decodeAttributeValue(v asn1.RawValue) (string, error) {
+	switch v.Tag {
+	case asn1.TagUTF8String, asn1.TagIA5String, asn1.TagPrintableString, asn1.TagT61String:
+		return string(v.Bytes), nil
+	default:
+		var s string
+		if _, err := asn1.Unmarshal(v.FullBytes, &s); err != nil {
+			return "", err
+		}
+		return s, nil
+	}
+}
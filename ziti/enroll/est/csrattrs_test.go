@@ -0,0 +1,113 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package est
+
+import (
+	"encoding/asn1"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// attrOrOID mirrors RFC 7030's AttrOrOID SEQUENCE { Type OID, Values SET OF AttributeValue }, used
+// here to build known-answer CsrAttrs DER independently of the decoding logic under test.
+type attrOrOID struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+// ia5Attr is the test-only input form for an AttrOrOID whose values are IA5Strings (as EST servers
+// use for subjectAltName DNS values).
+type ia5Attr struct {
+	Type   asn1.ObjectIdentifier
+	Values []string
+}
+
+func marshalCsrAttrs(t *testing.T, bareOIDs []asn1.ObjectIdentifier, attrs []ia5Attr) []byte {
+	t.Helper()
+
+	var raw []asn1.RawValue
+	for _, oid := range bareOIDs {
+		b, err := asn1.Marshal(oid)
+		require.NoError(t, err)
+		raw = append(raw, asn1.RawValue{FullBytes: b})
+	}
+	for _, a := range attrs {
+		var values []asn1.RawValue
+		for _, v := range a.Values {
+			b, err := asn1.MarshalWithParams(v, "ia5")
+			require.NoError(t, err)
+			values = append(values, asn1.RawValue{FullBytes: b})
+		}
+		b, err := asn1.Marshal(attrOrOID{Type: a.Type, Values: values})
+		require.NoError(t, err)
+		raw = append(raw, asn1.RawValue{FullBytes: b})
+	}
+
+	der, err := asn1.Marshal(raw)
+	require.NoError(t, err)
+	return der
+}
+
+func TestParseCSRAttrs_BareOID(t *testing.T) {
+	challengePassword := asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 7}
+	der := marshalCsrAttrs(t, []asn1.ObjectIdentifier{challengePassword}, nil)
+	body := []byte(base64.StdEncoding.EncodeToString(der))
+
+	attrs, err := ParseCSRAttrs(body)
+	require.NoError(t, err)
+	require.Len(t, attrs.OIDs, 1)
+	require.Equal(t, challengePassword.String(), attrs.OIDs[0].String())
+	require.Empty(t, attrs.Attributes)
+	require.True(t, attrs.Requests(challengePassword.String()))
+	require.False(t, attrs.Requests("2.5.29.17"))
+}
+
+func TestParseCSRAttrs_AttributeWithIA5Values(t *testing.T) {
+	subjectAltName := asn1.ObjectIdentifier{2, 5, 29, 17}
+	der := marshalCsrAttrs(t, nil, []ia5Attr{
+		{Type: subjectAltName, Values: []string{"host1.example.com", "host2.example.com"}},
+	})
+	body := []byte(base64.StdEncoding.EncodeToString(der))
+
+	attrs, err := ParseCSRAttrs(body)
+	require.NoError(t, err)
+	require.Empty(t, attrs.OIDs)
+	require.Equal(t, []string{"host1.example.com", "host2.example.com"}, attrs.Attributes[subjectAltName.String()])
+	require.False(t, attrs.Requests(subjectAltName.String()))
+}
+
+func TestParseCSRAttrs_MixedBareAndAttribute(t *testing.T) {
+	challengePassword := asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 7}
+	subjectAltName := asn1.ObjectIdentifier{2, 5, 29, 17}
+	der := marshalCsrAttrs(t,
+		[]asn1.ObjectIdentifier{subjectAltName},
+		[]ia5Attr{{Type: challengePassword, Values: []string{"s3cr3t"}}},
+	)
+	body := []byte(base64.StdEncoding.EncodeToString(der))
+
+	attrs, err := ParseCSRAttrs(body)
+	require.NoError(t, err)
+	require.True(t, attrs.Requests(subjectAltName.String()))
+	require.Equal(t, []string{"s3cr3t"}, attrs.Attributes[challengePassword.String()])
+}
+
+func TestParseCSRAttrs_InvalidBase64(t *testing.T) {
+	_, err := ParseCSRAttrs([]byte("not-valid-base64!!"))
+	require.Error(t, err)
+}
@@ -0,0 +1,102 @@
+// +build cloudkms
+
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package kms
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+
+	gcpkms "cloud.google.com/go/kms/apiv1"
+	"github.com/pkg/errors"
+	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+)
+
+// gcpSigner implements crypto.Signer by delegating Sign to GCP Cloud KMS's AsymmetricSign RPC; the
+// private key material never leaves Google's infrastructure.
+type gcpSigner struct {
+	client       *gcpkms.KeyManagementClient
+	resourceName string
+	public       crypto.PublicKey
+}
+
+func newGCPSigner(client *gcpkms.KeyManagementClient, resourceName string) (*gcpSigner, error) {
+	ctx := context.Background()
+
+	pub, err := client.GetPublicKey(ctx, &kmspb.GetPublicKeyRequest{Name: resourceName})
+	if err != nil {
+		return nil, errors.Errorf("could not fetch gcp kms public key for '%s': %s", resourceName, err.Error())
+	}
+
+	pubKey, err := parsePEMPublicKey(pub.Pem)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gcpSigner{client: client, resourceName: resourceName, public: pubKey}, nil
+}
+
+func (s *gcpSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *gcpSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	ctx := context.Background()
+
+	req := &kmspb.AsymmetricSignRequest{
+		Name: s.resourceName,
+	}
+
+	switch opts.HashFunc() {
+	case crypto.SHA256:
+		req.Digest = &kmspb.Digest{Digest: &kmspb.Digest_Sha256{Sha256: digest}}
+	case crypto.SHA384:
+		req.Digest = &kmspb.Digest{Digest: &kmspb.Digest_Sha384{Sha384: digest}}
+	default:
+		return nil, errors.Errorf("unsupported digest algorithm for gcp kms: %s", opts.HashFunc())
+	}
+
+	resp, err := s.client.AsymmetricSign(ctx, req)
+	if err != nil {
+		return nil, errors.Errorf("gcp kms sign failed: %s", err.Error())
+	}
+
+	return resp.Signature, nil
+}
+
+func parsePEMPublicKey(pemStr string) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(pemStr))
+	if block == nil {
+		return nil, errors.New("gcp kms returned an unparseable public key")
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Errorf("could not parse gcp kms public key: %s", err.Error())
+	}
+
+	ecKey, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("gcp kms key is not an ecdsa key")
+	}
+	return ecKey, nil
+}
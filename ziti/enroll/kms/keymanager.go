@@ -0,0 +1,64 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package kms abstracts private key generation and signing behind a KeyManager interface, modeled
+// on step-ca's kms.KeyManager, so enrollment can be backed by an in-process key, a PKCS#11 token, or
+// a cloud KMS instead of always generating a software key.
+package kms
+
+import (
+	"crypto"
+
+	"github.com/pkg/errors"
+)
+
+// KeyURI identifies a key managed by a KeyManager. For the Software manager this is a "pem:"
+// literal identical to what ziti/enroll has always stored in cfg.ID.Key; for HSM/KMS-backed
+// managers it is an opaque URI such as "pkcs11:token=ziti;object=identity" or
+// "gcpkms:projects/p/locations/l/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1".
+type KeyURI string
+
+// KeySpec describes the key a caller wants created. Not every field applies to every manager;
+// managers ignore fields they don't need (e.g. a KMS backend ignores Curve because the key ring
+// dictates the algorithm).
+type KeySpec struct {
+	// Curve names the elliptic curve for managers that generate the key themselves (e.g.
+	// "P-384"). Defaults to "P-384" to match the SDK's historical default.
+	Curve string
+
+	// Name is a manager-specific hint for where/how to create the key (e.g. a PKCS#11 object
+	// label, or a cloud KMS key version resource name). Software ignores it.
+	Name string
+}
+
+// KeyManager creates and resolves signing keys for identity enrollment. All enrollment key
+// operations should be routed through an implementation of this interface rather than calling
+// crypto/ecdsa directly, so HSM- and cloud-KMS-backed identities are a drop-in swap.
+type KeyManager interface {
+	// CreateKey provisions a new key per spec and returns a Signer usable immediately, along
+	// with the KeyURI that should be persisted (in cfg.ID.Key) to resolve it again later via
+	// GetSigner.
+	CreateKey(spec KeySpec) (crypto.Signer, KeyURI, error)
+
+	// GetSigner resolves a previously created KeyURI back into a usable Signer.
+	GetSigner(uri KeyURI) (crypto.Signer, error)
+
+	// Close releases any resources (HSM sessions, KMS client connections) held by the manager.
+	Close() error
+}
+
+// ErrUnsupportedURI is returned by GetSigner when a KeyURI's scheme isn't one the manager handles.
+var ErrUnsupportedURI = errors.New("key manager does not support this key uri")
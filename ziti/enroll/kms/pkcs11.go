@@ -0,0 +1,148 @@
+// +build pkcs11
+
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package kms
+
+import (
+	"crypto"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/pkg/errors"
+)
+
+// PKCS11 is a KeyManager backed by a PKCS#11 token (HSM, TPM, or YubiKey PIV applet), configured via
+// URIs of the form "pkcs11:token=ziti;object=identity;id=<hex>". Building with this backend requires
+// the "pkcs11" build tag and a working PKCS#11 module/cgo toolchain.
+type PKCS11 struct {
+	ctx        *crypto11.Context
+	tokenLabel string
+}
+
+// PKCS11Config configures the PKCS#11 module used by NewPKCS11.
+type PKCS11Config struct {
+	// ModulePath is the path to the vendor's PKCS#11 shared library (e.g.
+	// /usr/lib/softhsm/libsofthsm2.so).
+	ModulePath string
+
+	// TokenLabel selects which token on the module to use.
+	TokenLabel string
+
+	// Pin authenticates to the token.
+	Pin string
+}
+
+// NewPKCS11 opens a session against the configured PKCS#11 module.
+func NewPKCS11(cfg PKCS11Config) (*PKCS11, error) {
+	ctx, err := crypto11.Configure(&crypto11.Config{
+		Path:       cfg.ModulePath,
+		TokenLabel: cfg.TokenLabel,
+		Pin:        cfg.Pin,
+	})
+	if err != nil {
+		return nil, errors.Errorf("could not open pkcs11 module '%s': %s", cfg.ModulePath, err.Error())
+	}
+
+	return &PKCS11{ctx: ctx, tokenLabel: cfg.TokenLabel}, nil
+}
+
+func (p *PKCS11) CreateKey(spec KeySpec) (crypto.Signer, KeyURI, error) {
+	curve := curveFor(spec.Curve)
+
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", err
+	}
+
+	label := spec.Name
+	if label == "" {
+		label = "ziti-identity"
+	}
+
+	signer, err := p.ctx.GenerateECDSAKeyPairWithLabel(id, []byte(label), curve)
+	if err != nil {
+		return nil, "", errors.Errorf("pkcs11 key generation failed: %s", err.Error())
+	}
+
+	uri := KeyURI(fmt.Sprintf("pkcs11:token=%s;object=%s;id=%s", p.tokenLabel, label, hex.EncodeToString(id)))
+	return signer, uri, nil
+}
+
+func (p *PKCS11) GetSigner(uri KeyURI) (crypto.Signer, error) {
+	u, err := url.Parse(string(uri))
+	if err != nil || u.Scheme != "pkcs11" {
+		return nil, ErrUnsupportedURI
+	}
+
+	params, err := parsePKCS11Attributes(u.Opaque)
+	if err != nil {
+		return nil, errors.Errorf("invalid pkcs11 key uri '%s': %s", uri, err.Error())
+	}
+
+	object := params["object"]
+
+	var id []byte
+	if idHex := params["id"]; idHex != "" {
+		id, err = hex.DecodeString(idHex)
+		if err != nil {
+			return nil, errors.Errorf("invalid pkcs11 key uri '%s': %s", uri, err.Error())
+		}
+	}
+
+	signer, err := p.ctx.FindKeyPair(id, []byte(object))
+	if err != nil {
+		return nil, errors.Errorf("pkcs11 key lookup failed: %s", err.Error())
+	}
+	if signer == nil {
+		return nil, errors.Errorf("pkcs11 key '%s' not found", uri)
+	}
+	return signer, nil
+}
+
+// parsePKCS11Attributes parses the semicolon-delimited attribute=value pairs that make up the
+// opaque part of an RFC 7512 "pkcs11:" URI, e.g. "token=ziti;object=identity;id=01020304". This
+// can't be done with net/url.ParseQuery, which expects "&"-delimited, percent-encoded query
+// parameters and (as of Go 1.17) rejects ";" as a separator outright.
+func parsePKCS11Attributes(opaque string) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for _, pair := range strings.Split(opaque, ";") {
+		if pair == "" {
+			continue
+		}
+
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.Errorf("malformed attribute '%s'", pair)
+		}
+
+		value, err := url.PathUnescape(kv[1])
+		if err != nil {
+			return nil, errors.Errorf("malformed attribute '%s': %s", pair, err.Error())
+		}
+		attrs[kv[0]] = value
+	}
+	return attrs, nil
+}
+
+func (p *PKCS11) Close() error {
+	return p.ctx.Close()
+}
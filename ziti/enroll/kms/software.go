@@ -0,0 +1,88 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package kms
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+
+	"github.com/openziti/foundation/identity/identity"
+	"github.com/pkg/errors"
+)
+
+// Software is the default KeyManager: it generates an in-process ECDSA key and serializes it as a
+// "pem:" literal KeyURI, preserving today's enrollment behavior exactly.
+type Software struct{}
+
+// NewSoftware returns the default, HSM-less KeyManager.
+func NewSoftware() *Software {
+	return &Software{}
+}
+
+func (s *Software) CreateKey(spec KeySpec) (crypto.Signer, KeyURI, error) {
+	curve := curveFor(spec.Curve)
+
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+
+	asnBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, "", err
+	}
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: asnBytes})
+
+	return key, KeyURI("pem:" + string(keyPem)), nil
+}
+
+func (s *Software) GetSigner(uri KeyURI) (crypto.Signer, error) {
+	if !strings.HasPrefix(string(uri), "pem:") && !strings.HasPrefix(string(uri), "file://") {
+		return nil, ErrUnsupportedURI
+	}
+
+	key, err := identity.LoadKey(string(uri))
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("loaded key does not support signing")
+	}
+	return signer, nil
+}
+
+func (s *Software) Close() error {
+	return nil
+}
+
+func curveFor(name string) elliptic.Curve {
+	switch name {
+	case "P-256":
+		return elliptic.P256()
+	case "P-521":
+		return elliptic.P521()
+	default:
+		return elliptic.P384()
+	}
+}
@@ -0,0 +1,50 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package renew
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Metrics are the Prometheus collectors a Renewer updates as it runs. Register them with a
+// caller-owned prometheus.Registerer to expose them alongside the rest of an application's metrics.
+type Metrics struct {
+	nextRenewal prometheus.Gauge
+	lastError   prometheus.Gauge
+	successes   prometheus.Counter
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		nextRenewal: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ziti_identity_renew_next_renewal_time_seconds",
+			Help: "Unix time of the next scheduled certificate renewal attempt.",
+		}),
+		lastError: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ziti_identity_renew_last_attempt_failed",
+			Help: "1 if the most recent renewal attempt failed, 0 otherwise.",
+		}),
+		successes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ziti_identity_renew_success_total",
+			Help: "Count of successful certificate renewals.",
+		}),
+	}
+}
+
+// Collectors returns the individual metrics for registration, e.g.
+// registerer.MustRegister(renewer.Metrics().Collectors()...).
+func (m *Metrics) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.nextRenewal, m.lastError, m.successes}
+}
@@ -0,0 +1,64 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package renew
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// renewMTLS authenticates to r.cfg.RenewURL with the current client certificate (the pattern used
+// by enrollCA) and expects a fresh PEM certificate chain back.
+func (r *Renewer) renewMTLS(ctx context.Context) (Rotated, error) {
+	clientCert := r.cfg.Identity.Cert()
+
+	client := http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs:      r.cfg.RootCAs,
+				Certificates: []tls.Certificate{*clientCert},
+			},
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.cfg.RenewURL, bytes.NewReader(nil))
+	if err != nil {
+		return Rotated{}, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return Rotated{}, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Rotated{}, errors.Errorf("renew: could not read body: %s", err.Error())
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return Rotated{}, errors.Errorf("renew error: %s: %s", resp.Status, body)
+	}
+
+	return Rotated{Cert: body}, nil
+}
@@ -0,0 +1,214 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package renew
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/michaelquigley/pfxlog"
+	"github.com/netfoundry/ziti-sdk-golang/ziti/enroll"
+	"github.com/openziti/foundation/identity/certtools"
+	"github.com/pkg/errors"
+)
+
+// rekey generates a fresh keypair, has it signed against r.cfg.RenewURL (authenticated with the
+// certificate currently being replaced), and swaps both the key and certificate files on disk via
+// swapKeyAndCert.
+func (r *Renewer) rekey(ctx context.Context) (Rotated, error) {
+	keyGen := r.cfg.KeyGen
+	if keyGen == nil {
+		keyGen = defaultKeyGen
+	}
+
+	signer, err := keyGen()
+	if err != nil {
+		return Rotated{}, errors.Errorf("rekey: could not generate key: %s", err.Error())
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return Rotated{}, err
+	}
+
+	request, err := certtools.NewCertRequest(map[string]string{
+		"C": "US", "O": "NetFoundry", "CN": hostname,
+	}, nil)
+	if err != nil {
+		return Rotated{}, err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, request, signer)
+	if err != nil {
+		return Rotated{}, err
+	}
+	csrPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})
+
+	clientCert := r.cfg.Identity.Cert()
+	client := http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs:      r.cfg.RootCAs,
+				Certificates: []tls.Certificate{*clientCert},
+			},
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.cfg.RenewURL, bytes.NewReader(csrPem))
+	if err != nil {
+		return Rotated{}, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return Rotated{}, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	certPem, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Rotated{}, errors.Errorf("rekey: could not read body: %s", err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Rotated{}, errors.Errorf("rekey error: %s: %s", resp.Status, certPem)
+	}
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return Rotated{}, err
+	}
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+
+	if err := swapKeyAndCert(r.cfg.KeyPath, keyPem, r.cfg.CertPath, certPem); err != nil {
+		return Rotated{}, err
+	}
+
+	return Rotated{Cert: certPem, Key: keyPem}, nil
+}
+
+// swapKeyAndCert installs keyPem at keyPath and certPem at certPath: both are staged into fsync'd
+// temp files first, then renamed into place back-to-back, so only a crash between the two renames
+// can leave one half updated. If the certificate rename itself fails, the previous key (when one
+// existed) is written back. Either path may be empty, in which case that half is skipped.
+func swapKeyAndCert(keyPath string, keyPem []byte, certPath string, certPem []byte) error {
+	var keyTmp, certTmp string
+	var err error
+
+	if keyPath != "" {
+		if keyTmp, err = writeTempFile(keyPath, keyPem); err != nil {
+			return errors.Errorf("rekey: could not stage new key: %s", err.Error())
+		}
+	}
+	if certPath != "" {
+		if certTmp, err = writeTempFile(certPath, certPem); err != nil {
+			if keyTmp != "" {
+				_ = os.Remove(keyTmp)
+			}
+			return errors.Errorf("rekey: could not stage new certificate: %s", err.Error())
+		}
+	}
+
+	var keyBackup []byte
+	if keyTmp != "" {
+		// best-effort: if renaming the new cert into place fails below, this lets us restore the
+		// key so the on-disk pair never ends up as new-key/old-cert.
+		keyBackup, _ = ioutil.ReadFile(keyPath)
+
+		if err := os.Rename(keyTmp, keyPath); err != nil {
+			_ = os.Remove(keyTmp)
+			if certTmp != "" {
+				_ = os.Remove(certTmp)
+			}
+			return errors.Errorf("rekey: could not install new key: %s", err.Error())
+		}
+	}
+
+	if certTmp != "" {
+		if err := os.Rename(certTmp, certPath); err != nil {
+			if keyBackup != nil {
+				if rbErr := writeFileAtomic(keyPath, keyBackup); rbErr != nil {
+					pfxlog.Logger().WithError(rbErr).Error("rekey: could not roll back key after certificate install failed; identity is now mismatched")
+				}
+			}
+			return errors.Errorf("rekey: could not install new certificate: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+func defaultKeyGen() (crypto.Signer, error) {
+	key, err := enroll.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("generated key does not support signing")
+	}
+	return signer, nil
+}
+
+// writeTempFile writes data to a sibling temp file for path and fsyncs it, without renaming it into
+// place, so the caller can stage several files before committing any of them.
+func writeTempFile(path string, data []byte) (string, error) {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	tmpName := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmpName)
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmpName)
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmpName)
+		return "", err
+	}
+	if err := os.Chmod(tmpName, 0600); err != nil {
+		_ = os.Remove(tmpName)
+		return "", err
+	}
+	return tmpName, nil
+}
+
+// writeFileAtomic writes data to a sibling temp file, fsyncs it, then renames it over path so
+// readers never observe a partially-written key or certificate.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := writeTempFile(path, data)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,82 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package renew
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSwapKeyAndCert_Success(t *testing.T) {
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "key.pem")
+	certPath := filepath.Join(dir, "cert.pem")
+
+	require.NoError(t, ioutil.WriteFile(keyPath, []byte("old-key"), 0600))
+	require.NoError(t, ioutil.WriteFile(certPath, []byte("old-cert"), 0600))
+
+	err := swapKeyAndCert(keyPath, []byte("new-key"), certPath, []byte("new-cert"))
+	require.NoError(t, err)
+
+	keyContents, err := ioutil.ReadFile(keyPath)
+	require.NoError(t, err)
+	require.Equal(t, "new-key", string(keyContents))
+
+	certContents, err := ioutil.ReadFile(certPath)
+	require.NoError(t, err)
+	require.Equal(t, "new-cert", string(certContents))
+}
+
+// TestSwapKeyAndCert_RollsBackKeyOnCertFailure makes the certificate rename fail (certPath is a
+// directory, so renaming a regular file over it always fails) after the key rename has already
+// succeeded, and verifies the old key is restored rather than
+// leaving the identity with a new key paired with the old (or no) certificate.
+func TestSwapKeyAndCert_RollsBackKeyOnCertFailure(t *testing.T) {
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "key.pem")
+	certPath := filepath.Join(dir, "cert.pem")
+
+	require.NoError(t, ioutil.WriteFile(keyPath, []byte("old-key"), 0600))
+	require.NoError(t, os.Mkdir(certPath, 0700))
+
+	err := swapKeyAndCert(keyPath, []byte("new-key"), certPath, []byte("new-cert"))
+	require.Error(t, err)
+
+	keyContents, err := ioutil.ReadFile(keyPath)
+	require.NoError(t, err)
+	require.Equal(t, "old-key", string(keyContents), "key must be rolled back when the certificate half of the swap fails")
+
+	info, err := os.Stat(certPath)
+	require.NoError(t, err)
+	require.True(t, info.IsDir(), "certPath must be untouched when its rename fails")
+}
+
+func TestSwapKeyAndCert_EmptyPathsSkipped(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+
+	err := swapKeyAndCert("", []byte("new-key"), certPath, []byte("new-cert"))
+	require.NoError(t, err)
+
+	certContents, err := ioutil.ReadFile(certPath)
+	require.NoError(t, err)
+	require.Equal(t, "new-cert", string(certContents))
+}
@@ -0,0 +1,246 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package renew monitors an enrolled ziti identity's certificate expiration and reissues it before
+// expiry, analogous to smallstep's `ca renew`/`ca rekey`.
+package renew
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	mrand "math/rand"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/michaelquigley/pfxlog"
+	"github.com/openziti/foundation/identity/identity"
+	"github.com/pkg/errors"
+)
+
+// Strategy selects how a Renewer obtains new certificate material.
+type Strategy int
+
+const (
+	// MTLS renews by POSTing to RenewURL authenticated with the current client certificate,
+	// mirroring enrollCA, and expects a new PEM chain back.
+	MTLS Strategy = iota
+
+	// Rekey generates a fresh keypair (via KeyGen) in addition to a fresh certificate, then
+	// atomically replaces both cfg.ID.Key and cfg.ID.Cert on disk.
+	Rekey
+)
+
+// Rotated is delivered on a Renewer's channel (or handed to its callback) every time new key/cert
+// material is installed.
+type Rotated struct {
+	Cert []byte // PEM encoded leaf (+ chain)
+	Key  []byte // PEM encoded key; nil unless Strategy == Rekey
+}
+
+// Config controls a Renewer's behavior.
+type Config struct {
+	// Identity is the identity being kept fresh. Its Cert() is inspected to determine when the
+	// next renewal is due.
+	Identity identity.Identity
+
+	// KeyPath and CertPath are the on-disk files backing Identity's key/cert, required for
+	// Strategy == Rekey so the new material can be swapped in with fsync + rename.
+	KeyPath  string
+	CertPath string
+
+	// RenewURL is the mTLS renewal endpoint used by Strategy == MTLS, and the endpoint the new
+	// CSR is submitted to for Strategy == Rekey.
+	RenewURL string
+
+	Strategy Strategy
+
+	// RenewAt is the fraction of the certificate's lifetime (NotBefore..NotAfter) at which
+	// renewal is attempted; e.g. 2.0/3.0 renews at two thirds of life. Defaults to 2/3.
+	RenewAt float64
+
+	// Jitter is the maximum extra randomized delay added to each computed renewal time, to avoid
+	// a thundering herd of identities renewing simultaneously.
+	Jitter time.Duration
+
+	// KeyGen produces a new private key for Strategy == Rekey. Defaults to enroll.GenerateKey.
+	KeyGen func() (crypto.Signer, error)
+
+	// RootCAs, if set, is used to validate RenewURL; otherwise the system pool is used.
+	RootCAs *x509.CertPool
+
+	// Backoff governs retry of transient renewal failures. Defaults to a
+	// backoff.NewExponentialBackOff() with no max elapsed time (the Renewer itself is long-lived).
+	Backoff backoff.BackOff
+
+	// OnRotated, if set, is invoked (in addition to any channel returned by Run) whenever new
+	// material is installed.
+	OnRotated func(Rotated)
+}
+
+// Renewer monitors Config.Identity and reissues its certificate before expiry.
+type Renewer struct {
+	cfg     Config
+	metrics *Metrics
+
+	// leaf is the certificate untilNextRenewal schedules against. It starts as the leaf of
+	// cfg.Identity.Cert() (see leafOf) and is advanced to the newly issued certificate after each rotation,
+	// since renewMTLS's Rotated.Cert is handed to the caller (via OnRotated/the Run channel) rather
+	// than written back through cfg.Identity - relying on cfg.Identity.Cert() after the first
+	// rotation would keep observing the now-expired certificate and spin untilNextRenewal at 0.
+	leaf *x509.Certificate
+}
+
+// New builds a Renewer from cfg, filling in documented defaults for zero-valued fields.
+func New(cfg Config) *Renewer {
+	if cfg.RenewAt <= 0 {
+		cfg.RenewAt = 2.0 / 3.0
+	}
+	if cfg.Backoff == nil {
+		eb := backoff.NewExponentialBackOff()
+		eb.MaxElapsedTime = 0
+		cfg.Backoff = eb
+	}
+	return &Renewer{cfg: cfg, metrics: newMetrics()}
+}
+
+// Metrics exposes this Renewer's Prometheus collectors (next renewal time, last error, successful
+// renewal count) for registration with a caller-owned prometheus.Registerer.
+func (r *Renewer) Metrics() *Metrics {
+	return r.metrics
+}
+
+// Run monitors the certificate's expiration and renews it until ctx is done, emitting a Rotated on
+// the returned channel after each successful renewal. It also stops, closing the channel, if a
+// renewed certificate cannot be parsed.
+func (r *Renewer) Run(ctx context.Context) <-chan Rotated {
+	out := make(chan Rotated, 1)
+
+	if cert := r.cfg.Identity.Cert(); cert != nil {
+		if leaf, err := leafOf(cert); err != nil {
+			pfxlog.Logger().WithError(err).Error("could not parse identity certificate, renewal scheduling may be inaccurate")
+		} else {
+			r.leaf = leaf
+		}
+	}
+
+	go func() {
+		defer close(out)
+
+		for {
+			wait := r.untilNextRenewal()
+			r.metrics.nextRenewal.Set(float64(time.Now().Add(wait).Unix()))
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+
+			rotated, err := r.renewWithBackoff(ctx)
+			if err != nil {
+				pfxlog.Logger().WithError(err).Error("certificate renewal failed")
+				r.metrics.lastError.Set(1)
+				continue
+			}
+			r.metrics.lastError.Set(0)
+			r.metrics.successes.Inc()
+
+			if leaf, err := parseLeaf(rotated.Cert); err != nil {
+				// Without a parsed leaf we can't safely schedule the next renewal; fail loudly
+				// instead of silently spinning against the stale r.leaf.
+				pfxlog.Logger().WithError(err).Error("could not parse renewed certificate, stopping renewer")
+				return
+			} else {
+				r.leaf = leaf
+			}
+
+			if r.cfg.OnRotated != nil {
+				r.cfg.OnRotated(rotated)
+			}
+
+			select {
+			case out <- rotated:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// parseLeaf decodes the first CERTIFICATE block of pemBytes.
+func parseLeaf(pemBytes []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("no PEM certificate block found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// leafOf returns cert's leaf certificate, parsing it from cert.Certificate[0]'s DER bytes rather
+// than trusting cert.Leaf, which is frequently left nil by loaders (including
+// identity.LoadIdentity/tls.X509KeyPair) that never call x509.ParseCertificate on it.
+func leafOf(cert *tls.Certificate) (*x509.Certificate, error) {
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("identity certificate has no DER bytes")
+	}
+	return x509.ParseCertificate(cert.Certificate[0])
+}
+
+func (r *Renewer) untilNextRenewal() time.Duration {
+	if r.leaf == nil {
+		return 0
+	}
+
+	lifetime := r.leaf.NotAfter.Sub(r.leaf.NotBefore)
+	renewAt := r.leaf.NotBefore.Add(time.Duration(float64(lifetime) * r.cfg.RenewAt))
+
+	jitter := time.Duration(0)
+	if r.cfg.Jitter > 0 {
+		jitter = time.Duration(mrand.Int63n(int64(r.cfg.Jitter)))
+	}
+
+	wait := time.Until(renewAt) + jitter
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+func (r *Renewer) renewWithBackoff(ctx context.Context) (Rotated, error) {
+	var rotated Rotated
+
+	op := func() error {
+		var err error
+		switch r.cfg.Strategy {
+		case Rekey:
+			rotated, err = r.rekey(ctx)
+		default:
+			rotated, err = r.renewMTLS(ctx)
+		}
+		return err
+	}
+
+	err := backoff.Retry(op, backoff.WithContext(r.cfg.Backoff, ctx))
+	return rotated, err
+}